@@ -0,0 +1,179 @@
+// mautrix-imessage - A Matrix-iMessage puppeting bridge.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package ios
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"go.mau.fi/mautrix-imessage/imessage"
+	"go.mau.fi/mautrix-imessage/ipc"
+)
+
+// IncomingSendAck is sent by the iOS side once it has actually handed a
+// previously requested send off to iMessage, carrying the bridge-generated
+// MessageID back so it can be correlated with the pending WaitForDelivery
+// call that's waiting on it.
+const IncomingSendAck ipc.Command = "send_ack"
+
+// SendAckRequest is the payload of an IncomingSendAck frame.
+type SendAckRequest struct {
+	ChatGUID  string `json:"chat_guid"`
+	MessageID string `json:"message_id"`
+	imessage.SendResponse
+}
+
+// ReadReceiptRequest is the payload of an IncomingReadReceipt frame.
+type ReadReceiptRequest struct {
+	ChatGUID   string  `json:"chat_guid"`
+	MessageID  string  `json:"message_id"`
+	JSONIsRead bool    `json:"is_read"`
+	JSONReadAt float64 `json:"read_at"`
+}
+
+// ReceiptState is the delivery state a ReceiptUpdate reports.
+type ReceiptState int
+
+const (
+	ReceiptDelivered ReceiptState = iota
+	ReceiptRead
+)
+
+// ReceiptUpdate is a delivered/read state change for a previously sent
+// message, surfaced on iOSConnector.ReceiptChan().
+type ReceiptUpdate struct {
+	ChatGUID  string
+	MessageID string
+	State     ReceiptState
+	Time      time.Time
+}
+
+func generateMessageID() string {
+	return newTransferID()
+}
+
+// registerPendingAck allocates the channel a later WaitForDelivery call will
+// read from and returns the message ID it's keyed under.
+func (ios *iOSConnector) registerPendingAck() (string, chan *imessage.SendResponse) {
+	id := generateMessageID()
+	ch := make(chan *imessage.SendResponse, 1)
+	ios.pendingAcksLock.Lock()
+	ios.pendingAcks[id] = ch
+	ios.pendingAcksLock.Unlock()
+	return id, ch
+}
+
+// WaitForDelivery blocks until the iOS side acknowledges the message with
+// the given ID, or the context expires. The ack is only delivered to a call
+// that is already waiting: handleIncomingSendAck removes the ID from
+// pendingAcks, so a call made after the ack arrived returns a "no pending
+// send" error.
+func (ios *iOSConnector) WaitForDelivery(ctx context.Context, id string) (*imessage.SendResponse, error) {
+	ios.pendingAcksLock.Lock()
+	ch, ok := ios.pendingAcks[id]
+	ios.pendingAcksLock.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("no pending send with ID %s", id)
+	}
+	defer func() {
+		ios.pendingAcksLock.Lock()
+		delete(ios.pendingAcks, id)
+		ios.pendingAcksLock.Unlock()
+	}()
+	select {
+	case resp := <-ch:
+		return resp, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// ReceiptChan returns delivered/read state changes for messages previously
+// sent through this connector.
+func (ios *iOSConnector) ReceiptChan() <-chan *ReceiptUpdate {
+	return ios.receiptChan
+}
+
+func (ios *iOSConnector) handleIncomingSendAck(data json.RawMessage) interface{} {
+	var ack SendAckRequest
+	err := json.Unmarshal(data, &ack)
+	if err != nil {
+		ios.log.Warnln("Failed to parse incoming send ack: %v", err)
+		return nil
+	}
+	ios.pendingAcksLock.Lock()
+	ch, ok := ios.pendingAcks[ack.MessageID]
+	if ok {
+		delete(ios.pendingAcks, ack.MessageID)
+	}
+	ios.pendingAcksLock.Unlock()
+	if ok {
+		resp := ack.SendResponse
+		select {
+		case ch <- &resp:
+		default:
+		}
+	} else {
+		ios.log.Debugfln("Received send ack for unknown or already-resolved message %s", ack.MessageID)
+	}
+	// OnAck and the receipt publish below must happen regardless of whether
+	// a WaitForDelivery caller is still around to receive on ch: a queued
+	// retry's ack must still forget the item from bbolt, and a consumer
+	// watching ReceiptChan() instead of calling WaitForDelivery must still
+	// see it, even if pendingAcks was already cleaned up (e.g. a prior
+	// WaitForDelivery call timed out and deleted the entry itself).
+	ios.sendQueue.OnAck(ack.MessageID)
+	update := &ReceiptUpdate{
+		ChatGUID:  ack.ChatGUID,
+		MessageID: ack.MessageID,
+		State:     ReceiptDelivered,
+		Time:      time.Now(),
+	}
+	select {
+	case ios.receiptChan <- update:
+	default:
+		ios.log.Warnln("Receipt buffer is full, dropping delivery receipt for %s", update.MessageID)
+	}
+	return nil
+}
+
+func (ios *iOSConnector) handleIncomingReadReceipt(data json.RawMessage) interface{} {
+	var receipt ReadReceiptRequest
+	err := json.Unmarshal(data, &receipt)
+	if err != nil {
+		ios.log.Warnln("Failed to parse incoming read receipt: %v", err)
+		return nil
+	}
+	state := ReceiptDelivered
+	if receipt.JSONIsRead {
+		state = ReceiptRead
+	}
+	update := &ReceiptUpdate{
+		ChatGUID:  receipt.ChatGUID,
+		MessageID: receipt.MessageID,
+		State:     state,
+		Time:      floatToTime(receipt.JSONReadAt),
+	}
+	select {
+	case ios.receiptChan <- update:
+	default:
+		ios.log.Warnln("Receipt buffer is full, dropping receipt for %s", update.MessageID)
+	}
+	return nil
+}
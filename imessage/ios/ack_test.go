@@ -0,0 +1,98 @@
+// mautrix-imessage - A Matrix-iMessage puppeting bridge.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package ios
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestWaitForDeliveryResolvedByIncomingSendAck(t *testing.T) {
+	ios := newTestConnector(t, &stubService{})
+	defer ios.sendQueue.Stop()
+
+	id, _ := ios.registerPendingAck()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	waitDone := make(chan error, 1)
+	go func() {
+		_, err := ios.WaitForDelivery(ctx, id)
+		waitDone <- err
+	}()
+	// Give the waiter time to block on its channel: an ack handled before
+	// WaitForDelivery looks up the ID removes it from pendingAcks.
+	time.Sleep(50 * time.Millisecond)
+
+	ack, err := json.Marshal(SendAckRequest{ChatGUID: "chat-guid", MessageID: id})
+	if err != nil {
+		t.Fatalf("failed to marshal ack: %v", err)
+	}
+	ios.handleIncomingSendAck(ack)
+
+	if err := <-waitDone; err != nil {
+		t.Fatalf("WaitForDelivery failed: %v", err)
+	}
+
+	ios.pendingAcksLock.Lock()
+	_, stillPending := ios.pendingAcks[id]
+	ios.pendingAcksLock.Unlock()
+	if stillPending {
+		t.Errorf("pendingAcks entry for %s was not cleaned up", id)
+	}
+
+	select {
+	case update := <-ios.receiptChan:
+		if update.State != ReceiptDelivered || update.MessageID != id {
+			t.Errorf("unexpected receipt update: %+v", update)
+		}
+	default:
+		t.Errorf("no delivery receipt was published to ReceiptChan")
+	}
+}
+
+func TestWaitForDeliveryTimeoutDoesNotSuppressLateAck(t *testing.T) {
+	ios := newTestConnector(t, &stubService{})
+	defer ios.sendQueue.Stop()
+
+	id, _ := ios.registerPendingAck()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	if _, err := ios.WaitForDelivery(ctx, id); err == nil {
+		t.Fatalf("expected WaitForDelivery to time out")
+	}
+
+	// The ack arrives after the waiter already gave up and cleaned up
+	// pendingAcks; OnAck and the receipt publish must still happen.
+	ack, err := json.Marshal(SendAckRequest{ChatGUID: "chat-guid", MessageID: id})
+	if err != nil {
+		t.Fatalf("failed to marshal ack: %v", err)
+	}
+	ios.handleIncomingSendAck(ack)
+
+	select {
+	case update := <-ios.receiptChan:
+		if update.State != ReceiptDelivered || update.MessageID != id {
+			t.Errorf("unexpected receipt update: %+v", update)
+		}
+	default:
+		t.Errorf("late ack after WaitForDelivery timeout did not publish a receipt")
+	}
+}
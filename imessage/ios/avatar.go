@@ -0,0 +1,83 @@
+// mautrix-imessage - A Matrix-iMessage puppeting bridge.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package ios
+
+import (
+	"context"
+	"encoding/base64"
+	"os"
+
+	"go.mau.fi/mautrix-imessage/imessage"
+	"go.mau.fi/mautrix-imessage/ipc"
+)
+
+const ReqGetGroupAvatar ipc.Command = "get_group_avatar"
+
+// GetGroupAvatarRequest asks the iOS side for a chat's current group photo.
+type GetGroupAvatarRequest struct {
+	ChatGUID string `json:"chat_guid"`
+}
+
+// GetGroupAvatarResponse carries the group photo bytes inline, base64-coded
+// the same way SendFileRequest frames are.
+type GetGroupAvatarResponse struct {
+	FileName string `json:"file_name"`
+	MimeType string `json:"mime_type"`
+	Data     string `json:"data"`
+}
+
+// GetGroupAvatar returns chatID's current group photo, reusing the last one
+// fetched without crossing the IPC boundary again as long as it's still on
+// disk.
+func (ios *iOSConnector) GetGroupAvatar(chatID string) (imessage.Attachment, error) {
+	if cached, ok := ios.avatarPaths.Get(chatID); ok {
+		if _, err := os.Stat(cached.path); err == nil {
+			return &cachedAttachment{
+				fileName: cached.fileName,
+				mimeType: cached.mimeType,
+				path:     cached.path,
+			}, nil
+		}
+	}
+
+	resp, err := ios.svc.GetGroupAvatar(context.Background(), &GetGroupAvatarRequest{ChatGUID: chatID})
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Data) == 0 {
+		return nil, nil
+	}
+	data, err := base64.StdEncoding.DecodeString(resp.Data)
+	if err != nil {
+		return nil, err
+	}
+	path, err := ios.attachments.Put(data)
+	if err != nil {
+		return nil, err
+	}
+	avatar := cachedAvatar{
+		path:     path,
+		fileName: sanitizeFilename(resp.FileName),
+		mimeType: resp.MimeType,
+	}
+	ios.avatarPaths.Set(chatID, avatar)
+	return &cachedAttachment{
+		fileName: avatar.fileName,
+		mimeType: avatar.mimeType,
+		path:     avatar.path,
+	}, nil
+}
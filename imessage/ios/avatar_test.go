@@ -0,0 +1,86 @@
+// mautrix-imessage - A Matrix-iMessage puppeting bridge.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package ios
+
+import (
+	"context"
+	"encoding/base64"
+	"testing"
+)
+
+func TestGetGroupAvatarFetchesAndCachesOnMiss(t *testing.T) {
+	calls := 0
+	svc := &stubService{
+		getGroupAvatar: func(context.Context, *GetGroupAvatarRequest) (*GetGroupAvatarResponse, error) {
+			calls++
+			return &GetGroupAvatarResponse{
+				FileName: "avatar.jpg",
+				MimeType: "image/jpeg",
+				Data:     base64.StdEncoding.EncodeToString([]byte("avatar-bytes")),
+			}, nil
+		},
+	}
+	ios := newTestConnector(t, svc)
+	defer ios.sendQueue.Stop()
+
+	attachment, err := ios.GetGroupAvatar("chat-guid")
+	if err != nil {
+		t.Fatalf("GetGroupAvatar failed: %v", err)
+	}
+	if attachment.GetFileName() != "avatar.jpg" {
+		t.Errorf("unexpected file name: %s", attachment.GetFileName())
+	}
+	if calls != 1 {
+		t.Fatalf("expected 1 IPC call, got %d", calls)
+	}
+
+	if cached, ok := ios.avatarPaths.Get("chat-guid"); !ok || cached.fileName != "avatar.jpg" {
+		t.Errorf("GetGroupAvatar did not populate avatarPaths: %+v, ok=%v", cached, ok)
+	}
+}
+
+func TestGetGroupAvatarShortCircuitsOnCacheHit(t *testing.T) {
+	svc := &stubService{
+		getGroupAvatar: func(context.Context, *GetGroupAvatarRequest) (*GetGroupAvatarResponse, error) {
+			t.Fatalf("GetGroupAvatar should not cross the IPC boundary on a cache hit")
+			return nil, nil
+		},
+	}
+	ios := newTestConnector(t, svc)
+	defer ios.sendQueue.Stop()
+
+	path, err := ios.attachments.Put([]byte("cached-avatar-bytes"))
+	if err != nil {
+		t.Fatalf("failed to seed attachment cache: %v", err)
+	}
+	ios.avatarPaths.Set("chat-guid", cachedAvatar{
+		path:     path,
+		fileName: "cached.jpg",
+		mimeType: "image/jpeg",
+	})
+
+	attachment, err := ios.GetGroupAvatar("chat-guid")
+	if err != nil {
+		t.Fatalf("GetGroupAvatar failed: %v", err)
+	}
+	if attachment.GetFileName() != "cached.jpg" {
+		t.Errorf("unexpected file name: %s", attachment.GetFileName())
+	}
+	if attachment.GetPathOnDisk() != path {
+		t.Errorf("unexpected path: got %s, want %s", attachment.GetPathOnDisk(), path)
+	}
+}
@@ -0,0 +1,137 @@
+// mautrix-imessage - A Matrix-iMessage puppeting bridge.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package ios
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// defaultAttachmentCacheDir is where attachmentCache stores content-addressed
+// attachment and avatar bytes, relative to the bridge's working directory.
+const defaultAttachmentCacheDir = "attachments-cache"
+
+// attachmentCache is a content-addressed on-disk store for attachment and
+// avatar bytes: the sha256 of the content is the cache key, so repeated
+// lookups of the same bytes never have to re-cross the IPC boundary. It's
+// shared by GetGroupAvatar and the inbound attachment path wired up for
+// SendFile/handleIncomingFile.
+type attachmentCache struct {
+	dir string
+}
+
+func newAttachmentCache(dir string) *attachmentCache {
+	return &attachmentCache{dir: dir}
+}
+
+// Put writes data to the cache if it isn't already there and returns its
+// path on disk.
+func (c *attachmentCache) Put(data []byte) (string, error) {
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+	subdir := filepath.Join(c.dir, hash[:2])
+	path := filepath.Join(subdir, hash)
+	if _, err := os.Stat(path); err == nil {
+		return path, nil
+	} else if !os.IsNotExist(err) {
+		return "", err
+	}
+	if err := os.MkdirAll(subdir, 0750); err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(path, data, 0640); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// cachedAttachment is a concrete imessage.Attachment backed by a file in an
+// attachmentCache.
+type cachedAttachment struct {
+	fileName string
+	mimeType string
+	path     string
+}
+
+func (a *cachedAttachment) GetFileName() string {
+	return a.fileName
+}
+
+func (a *cachedAttachment) GetMimeType() string {
+	return a.mimeType
+}
+
+func (a *cachedAttachment) GetPathOnDisk() string {
+	return a.path
+}
+
+func (a *cachedAttachment) Read(out *[]byte) error {
+	data, err := os.ReadFile(a.path)
+	if err != nil {
+		return err
+	}
+	*out = data
+	return nil
+}
+
+func (a *cachedAttachment) Remove() error {
+	return os.Remove(a.path)
+}
+
+// cachedAvatar is everything GetGroupAvatar needs to answer a repeat lookup
+// without crossing the IPC boundary again.
+type cachedAvatar struct {
+	path     string
+	fileName string
+	mimeType string
+}
+
+// groupAvatarPaths tracks, per chat, the most recently fetched group avatar,
+// so GetGroupAvatar and GetCachePath can answer without another IPC
+// round-trip.
+type groupAvatarPaths struct {
+	lock    sync.Mutex
+	avatars map[string]cachedAvatar
+}
+
+func newGroupAvatarPaths() *groupAvatarPaths {
+	return &groupAvatarPaths{avatars: make(map[string]cachedAvatar)}
+}
+
+func (p *groupAvatarPaths) Get(chatGUID string) (cachedAvatar, bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	avatar, ok := p.avatars[chatGUID]
+	return avatar, ok
+}
+
+func (p *groupAvatarPaths) Set(chatGUID string, avatar cachedAvatar) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.avatars[chatGUID] = avatar
+}
+
+// GetCachePath returns the on-disk path of the last group avatar fetched for
+// chatGUID via GetGroupAvatar, or an empty string if none has been cached
+// yet.
+func (ios *iOSConnector) GetCachePath(chatGUID string) string {
+	avatar, _ := ios.avatarPaths.Get(chatGUID)
+	return avatar.path
+}
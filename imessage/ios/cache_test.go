@@ -0,0 +1,62 @@
+// mautrix-imessage - A Matrix-iMessage puppeting bridge.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package ios
+
+import (
+	"os"
+	"testing"
+)
+
+func TestAttachmentCachePut(t *testing.T) {
+	cache := newAttachmentCache(t.TempDir())
+
+	path, err := cache.Put([]byte("hello world"))
+	if err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read cached file: %v", err)
+	}
+	if string(data) != "hello world" {
+		t.Errorf("cached content = %q, want %q", data, "hello world")
+	}
+}
+
+func TestAttachmentCachePutIsContentAddressed(t *testing.T) {
+	cache := newAttachmentCache(t.TempDir())
+
+	path1, err := cache.Put([]byte("same content"))
+	if err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	path2, err := cache.Put([]byte("same content"))
+	if err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if path1 != path2 {
+		t.Errorf("identical content cached at different paths: %q != %q", path1, path2)
+	}
+
+	path3, err := cache.Put([]byte("different content"))
+	if err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if path3 == path1 {
+		t.Errorf("different content cached at the same path: %q", path3)
+	}
+}
@@ -19,8 +19,8 @@ package ios
 import (
 	"context"
 	"encoding/json"
-	"errors"
 	"math"
+	"sync"
 	"time"
 
 	"go.mau.fi/mautrix-imessage/imessage"
@@ -31,6 +31,7 @@ import (
 const (
 	IncomingMessage     ipc.Command = "message"
 	IncomingReadReceipt ipc.Command = "read_receipt"
+	IncomingFile        ipc.Command = "file"
 )
 
 func floatToTime(unix float64) time.Time {
@@ -39,13 +40,29 @@ func floatToTime(unix float64) time.Time {
 }
 
 func timeToFloat(time time.Time) float64 {
-	return float64(time.Unix()) + float64(time.Nanosecond()) / 1e9
+	return float64(time.Unix()) + float64(time.Nanosecond())/1e9
 }
 
 type iOSConnector struct {
 	IPC         *ipc.Processor
 	log         log.Logger
+	svc         Service
 	messageChan chan *imessage.Message
+	fileChan    chan *ReceivedFile
+	receiptChan chan *ReceiptUpdate
+
+	incomingTransfersLock sync.Mutex
+	incomingTransfers     map[string]*incomingFileTransfer
+
+	pendingAcksLock sync.Mutex
+	pendingAcks     map[string]chan *imessage.SendResponse
+
+	attachments *attachmentCache
+	avatarPaths *groupAvatarPaths
+
+	sendQueue       *sendQueue
+	sendQueueCtx    context.Context
+	cancelSendQueue context.CancelFunc
 }
 
 func NewiOSConnector(bridge imessage.Bridge) (imessage.API, error) {
@@ -54,8 +71,25 @@ func NewiOSConnector(bridge imessage.Bridge) (imessage.API, error) {
 		log: bridge.GetLog().Sub("iMessage").Sub("iOS"),
 
 		messageChan: make(chan *imessage.Message, 256),
+		fileChan:    make(chan *ReceivedFile, 32),
+		receiptChan: make(chan *ReceiptUpdate, 256),
+
+		incomingTransfers: make(map[string]*incomingFileTransfer),
+		pendingAcks:       make(map[string]chan *imessage.SendResponse),
+
+		attachments: newAttachmentCache(defaultAttachmentCacheDir),
+		avatarPaths: newGroupAvatarPaths(),
 	}
+	ios.svc = newIPCService(ios)
 	ios.IPC.SetHandler(IncomingMessage, ios.handleIncomingMessage)
+	ios.IPC.SetHandler(IncomingFile, ios.handleIncomingFile)
+	ios.IPC.SetHandler(IncomingReadReceipt, ios.handleIncomingReadReceipt)
+	ios.IPC.SetHandler(IncomingSendAck, ios.handleIncomingSendAck)
+	sendQueue, err := newSendQueue(ios, defaultSendQueueDB)
+	if err != nil {
+		return nil, err
+	}
+	ios.sendQueue = sendQueue
 	return ios, nil
 }
 
@@ -64,11 +98,20 @@ func init() {
 }
 
 func (ios *iOSConnector) Start() error {
+	ios.sendQueueCtx, ios.cancelSendQueue = context.WithCancel(context.Background())
+	go ios.sendQueue.Run(ios.sendQueueCtx)
 	return nil
 }
 
 func (ios *iOSConnector) Stop() {
+	ios.cancelSendQueue()
+	ios.sendQueue.Stop()
+}
 
+// SendQueueStats returns the outbound queue's current backlog depth and the
+// age of its oldest pending item, for monitoring.
+func (ios *iOSConnector) SendQueueStats() SendQueueStats {
+	return ios.sendQueue.Stats()
 }
 
 func postprocessMessage(message *imessage.Message) {
@@ -95,11 +138,10 @@ func (ios *iOSConnector) handleIncomingMessage(data json.RawMessage) interface{}
 }
 
 func (ios *iOSConnector) GetMessagesSinceDate(chatID string, minDate time.Time) ([]*imessage.Message, error) {
-	resp := make([]*imessage.Message, 0)
-	err := ios.IPC.Request(context.Background(), ReqGetRecentMessages, &GetMessagesAfterRequest{
+	resp, err := ios.svc.GetRecentMessagesAfter(context.Background(), &GetMessagesAfterRequest{
 		ChatGUID:  chatID,
 		Timestamp: timeToFloat(minDate),
-	}, &resp)
+	})
 	for _, msg := range resp {
 		postprocessMessage(msg)
 	}
@@ -107,55 +149,75 @@ func (ios *iOSConnector) GetMessagesSinceDate(chatID string, minDate time.Time)
 }
 
 func (ios *iOSConnector) GetMessagesWithLimit(chatID string, limit int) ([]*imessage.Message, error) {
-	resp := make([]*imessage.Message, 0)
-	err := ios.IPC.Request(context.Background(), ReqGetRecentMessages, &GetRecentMessagesRequest{
+	resp, err := ios.svc.GetRecentMessagesWithLimit(context.Background(), &GetRecentMessagesRequest{
 		ChatGUID: chatID,
 		Limit:    limit,
-	}, &resp)
+	})
 	for _, msg := range resp {
 		postprocessMessage(msg)
 	}
 	return resp, err
 }
 
-func (ios *iOSConnector) GetChatsWithMessagesAfter(minDate time.Time) (resp []string, err error) {
-	return resp, ios.IPC.Request(context.Background(), ReqGetChats, &GetChatsRequest{
+func (ios *iOSConnector) GetChatsWithMessagesAfter(minDate time.Time) ([]string, error) {
+	return ios.svc.GetChats(context.Background(), &GetChatsRequest{
 		MinTimestamp: timeToFloat(minDate),
-	}, &resp)
+	})
 }
 
 func (ios *iOSConnector) MessageChan() <-chan *imessage.Message {
 	return ios.messageChan
 }
 
+// FileChan returns inbound attachments reassembled from chunked file
+// transfers. Kept separate from MessageChan so that attachment
+// download/caching doesn't block the regular message flow.
+func (ios *iOSConnector) FileChan() <-chan *ReceivedFile {
+	return ios.fileChan
+}
+
 func (ios *iOSConnector) GetContactInfo(identifier string) (*imessage.Contact, error) {
-	var resp imessage.Contact
-	err := ios.IPC.Request(context.Background(), ReqGetContact, &GetContactRequest{UserGUID: identifier}, &resp)
-	return &resp, err
+	return ios.svc.GetContact(context.Background(), &GetContactRequest{UserGUID: identifier})
 }
 
 func (ios *iOSConnector) GetChatInfo(chatID string) (*imessage.ChatInfo, error) {
-	var resp imessage.ChatInfo
-	err := ios.IPC.Request(context.Background(), ReqGetChat, &GetChatRequest{ChatGUID: chatID}, &resp)
-	return &resp, err
+	return ios.svc.GetChat(context.Background(), &GetChatRequest{ChatGUID: chatID})
 }
 
-func (ios *iOSConnector) GetGroupAvatar(chatID string) (imessage.Attachment, error) {
-	return nil, nil
+// SendMessage sends text immediately if the iOS IPC peer is reachable. If
+// the send fails, the message is handed to the outbound queue instead of
+// failing the caller, and retried in the background under the same
+// MessageID until the iOS side accepts it or the attempt budget is
+// exhausted; delivery itself is confirmed later by the matching send ack
+// (see WaitForDelivery).
+func (ios *iOSConnector) SendMessage(chatID, text string) (*imessage.SendResponse, error) {
+	id, _ := ios.registerPendingAck()
+	resp, err := ios.sendMessageWithID(chatID, text, id)
+	if err == nil {
+		return resp, nil
+	}
+	if queueErr := ios.sendQueue.EnqueueMessage(id, chatID, text); queueErr != nil {
+		ios.pendingAcksLock.Lock()
+		delete(ios.pendingAcks, id)
+		ios.pendingAcksLock.Unlock()
+		return nil, err
+	}
+	ios.log.Debugfln("Queued message %s to %s for retry after direct send failed: %v", id, chatID, err)
+	return &imessage.SendResponse{MessageID: id}, nil
 }
 
-func (ios *iOSConnector) SendMessage(chatID, text string) (*imessage.SendResponse, error) {
-	var resp imessage.SendResponse
-	err := ios.IPC.Request(context.Background(), ReqSendMessage, &SendMessageRequest{
-		ChatGUID: chatID,
-		Text:     text,
-	}, &resp)
+// sendMessageWithID performs one direct IPC send attempt under a
+// caller-chosen MessageID, so a queued retry echoes the same ID the
+// original caller is (or might later start) waiting on via WaitForDelivery.
+func (ios *iOSConnector) sendMessageWithID(chatID, text, id string) (*imessage.SendResponse, error) {
+	resp, err := ios.svc.SendMessage(context.Background(), &SendMessageRequest{
+		ChatGUID:  chatID,
+		Text:      text,
+		MessageID: id,
+	})
 	if err != nil {
 		return nil, err
 	}
-	return &resp, err
+	resp.MessageID = id
+	return resp, nil
 }
-
-func (ios *iOSConnector) SendFile(chatID, filename string, data []byte) (*imessage.SendResponse, error) {
-	return nil, errors.New("sending files is not implemented yet")
-}
\ No newline at end of file
@@ -0,0 +1,350 @@
+// mautrix-imessage - A Matrix-iMessage puppeting bridge.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package ios
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+// defaultSendQueueDB is where the outbound queue persists pending sends,
+// relative to the bridge's working directory.
+const defaultSendQueueDB = "send-queue.db"
+
+var sendQueueBucket = []byte("pending_sends")
+
+const (
+	sendQueueBaseBackoff = 1 * time.Second
+	sendQueueMaxBackoff  = 5 * time.Minute
+	sendQueueMaxAttempts = 10
+)
+
+// queuedSend is one outbound message or file waiting to be delivered to the
+// iOS side, persisted so it survives a bridge restart while the IPC peer is
+// disconnected.
+type queuedSend struct {
+	GUID        string    `json:"guid"`
+	ChatGUID    string    `json:"chat_guid"`
+	Text        string    `json:"text,omitempty"`
+	FileName    string    `json:"file_name,omitempty"`
+	FileData    []byte    `json:"file_data,omitempty"`
+	Attempts    int       `json:"attempts"`
+	CreatedAt   time.Time `json:"created_at"`
+	NextAttempt time.Time `json:"next_attempt"`
+}
+
+func (q *queuedSend) isFile() bool {
+	return len(q.FileName) > 0
+}
+
+// SendQueueStats is a snapshot of the outbound queue's backlog, returned by
+// sendQueue.Stats() for monitoring.
+type SendQueueStats struct {
+	Depth            int
+	OldestPendingAge time.Duration
+}
+
+// sendQueue sits in front of iOSConnector.SendMessage/SendFile: a send that
+// fails (most commonly because the iOS IPC peer is disconnected) is handed
+// to the queue instead of failing the caller, and retried with exponential
+// backoff, under the same MessageID every attempt, until the direct IPC
+// round-trip succeeds, the attempt budget is exhausted, or the queue's
+// context is cancelled. An item isn't forgotten the moment a retry's IPC
+// call returns, though: that only means the frame was handed off, not that
+// the iOS side actually delivered it, so the item moves to awaitingAck and
+// is only removed once handleIncomingSendAck reports the matching
+// IncomingSendAck (see OnAck).
+type sendQueue struct {
+	ios *iOSConnector
+	db  *bbolt.DB
+
+	wake   chan struct{}
+	stopCh chan struct{}
+
+	lock        sync.Mutex
+	pending     map[string]*queuedSend
+	awaitingAck map[string]*queuedSend
+}
+
+func newSendQueue(ios *iOSConnector, dbPath string) (*sendQueue, error) {
+	db, err := bbolt.Open(dbPath, 0600, &bbolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bbolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(sendQueueBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	q := &sendQueue{
+		ios:         ios,
+		db:          db,
+		wake:        make(chan struct{}, 1),
+		stopCh:      make(chan struct{}),
+		pending:     make(map[string]*queuedSend),
+		awaitingAck: make(map[string]*queuedSend),
+	}
+	if err = q.loadPending(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return q, nil
+}
+
+func (q *sendQueue) loadPending() error {
+	return q.db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket(sendQueueBucket).ForEach(func(k, v []byte) error {
+			var item queuedSend
+			if err := json.Unmarshal(v, &item); err != nil {
+				return err
+			}
+			q.lock.Lock()
+			q.pending[item.GUID] = &item
+			q.lock.Unlock()
+			return nil
+		})
+	})
+}
+
+func (q *sendQueue) persist(item *queuedSend) error {
+	data, err := json.Marshal(item)
+	if err != nil {
+		return err
+	}
+	return q.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(sendQueueBucket).Put([]byte(item.GUID), data)
+	})
+}
+
+func (q *sendQueue) forget(guid string) error {
+	return q.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(sendQueueBucket).Delete([]byte(guid))
+	})
+}
+
+func (q *sendQueue) enqueue(item *queuedSend) error {
+	q.lock.Lock()
+	q.pending[item.GUID] = item
+	q.lock.Unlock()
+	if err := q.persist(item); err != nil {
+		return err
+	}
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// EnqueueMessage persists a text message for background retry under guid,
+// the same MessageID the caller already has (and may be waiting on via
+// WaitForDelivery).
+func (q *sendQueue) EnqueueMessage(guid, chatGUID, text string) error {
+	return q.enqueue(&queuedSend{
+		GUID:      guid,
+		ChatGUID:  chatGUID,
+		Text:      text,
+		CreatedAt: time.Now(),
+	})
+}
+
+// EnqueueFile persists a file send for background retry under guid, the
+// same MessageID the caller already has (and may be waiting on via
+// WaitForDelivery).
+func (q *sendQueue) EnqueueFile(guid, chatGUID, filename string, data []byte) error {
+	return q.enqueue(&queuedSend{
+		GUID:      guid,
+		ChatGUID:  chatGUID,
+		FileName:  filename,
+		FileData:  data,
+		CreatedAt: time.Now(),
+	})
+}
+
+// Stats returns the current backlog depth (items still retrying plus items
+// sent but not yet acked) and the age of the oldest of them, for
+// monitoring.
+func (q *sendQueue) Stats() SendQueueStats {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	stats := SendQueueStats{Depth: len(q.pending) + len(q.awaitingAck)}
+	var oldest time.Time
+	for _, item := range q.pending {
+		if oldest.IsZero() || item.CreatedAt.Before(oldest) {
+			oldest = item.CreatedAt
+		}
+	}
+	for _, item := range q.awaitingAck {
+		if oldest.IsZero() || item.CreatedAt.Before(oldest) {
+			oldest = item.CreatedAt
+		}
+	}
+	if !oldest.IsZero() {
+		stats.OldestPendingAge = time.Since(oldest)
+	}
+	return stats
+}
+
+func backoffFor(attempts int) time.Duration {
+	d := sendQueueBaseBackoff
+	for i := 0; i < attempts; i++ {
+		d *= 2
+		if d >= sendQueueMaxBackoff {
+			return sendQueueMaxBackoff
+		}
+	}
+	return d
+}
+
+// Run drives retries until ctx is cancelled. It should be started in its own
+// goroutine.
+func (q *sendQueue) Run(ctx context.Context) {
+	for {
+		next := q.attemptDue()
+		wait := time.Minute
+		if !next.IsZero() {
+			if d := time.Until(next); d > 0 {
+				wait = d
+			} else {
+				wait = 0
+			}
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-q.stopCh:
+			timer.Stop()
+			return
+		case <-q.wake:
+			timer.Stop()
+		case <-timer.C:
+		}
+	}
+}
+
+// Stop signals Run to return and closes the underlying database.
+func (q *sendQueue) Stop() {
+	close(q.stopCh)
+	_ = q.db.Close()
+}
+
+// attemptDue sends every item whose NextAttempt has passed and returns the
+// NextAttempt of the earliest item still pending afterwards.
+func (q *sendQueue) attemptDue() time.Time {
+	now := time.Now()
+	var due []*queuedSend
+	var earliestFuture time.Time
+
+	q.lock.Lock()
+	for _, item := range q.pending {
+		if item.NextAttempt.After(now) {
+			if earliestFuture.IsZero() || item.NextAttempt.Before(earliestFuture) {
+				earliestFuture = item.NextAttempt
+			}
+			continue
+		}
+		due = append(due, item)
+	}
+	q.lock.Unlock()
+
+	for _, item := range due {
+		if q.trySend(item) {
+			continue
+		}
+		if earliestFuture.IsZero() || item.NextAttempt.Before(earliestFuture) {
+			earliestFuture = item.NextAttempt
+		}
+	}
+	return earliestFuture
+}
+
+// trySend attempts one delivery of item under its own MessageID (the GUID
+// it was enqueued with), updating, parking, or dropping it from the retry
+// set depending on the outcome, and reports whether it no longer needs
+// rescheduling (handed off successfully, or permanently failed).
+func (q *sendQueue) trySend(item *queuedSend) bool {
+	var err error
+	if item.isFile() {
+		_, err = q.ios.sendFileWithID(item.ChatGUID, item.FileName, item.FileData, item.GUID)
+	} else {
+		_, err = q.ios.sendMessageWithID(item.ChatGUID, item.Text, item.GUID)
+	}
+	if err == nil {
+		// Handed off to the iOS side, but not yet acknowledged: keep it
+		// persisted and move it out of the retry set. OnAck removes it for
+		// good once the matching IncomingSendAck arrives.
+		q.lock.Lock()
+		delete(q.pending, item.GUID)
+		q.awaitingAck[item.GUID] = item
+		q.lock.Unlock()
+		return true
+	}
+
+	item.Attempts++
+	if item.Attempts >= sendQueueMaxAttempts {
+		q.ios.log.Errorfln("Giving up on queued send %s to %s after %d attempts: %v", item.GUID, item.ChatGUID, item.Attempts, err)
+		q.lock.Lock()
+		delete(q.pending, item.GUID)
+		q.lock.Unlock()
+		if fErr := q.forget(item.GUID); fErr != nil {
+			q.ios.log.Warnln("Failed to remove abandoned item %s from send queue: %v", item.GUID, fErr)
+		}
+		// No ack will ever arrive for an item we've given up on, so
+		// handleIncomingSendAck never removes its pendingAcks entry.
+		// Clean up the registerPendingAck channel here
+		// instead, or it leaks for the life of the process.
+		q.ios.pendingAcksLock.Lock()
+		delete(q.ios.pendingAcks, item.GUID)
+		q.ios.pendingAcksLock.Unlock()
+		return true
+	}
+
+	item.NextAttempt = time.Now().Add(backoffFor(item.Attempts))
+	q.ios.log.Debugfln("Retrying queued send %s to %s in %s (attempt %d): %v", item.GUID, item.ChatGUID, time.Until(item.NextAttempt), item.Attempts, err)
+	if pErr := q.persist(item); pErr != nil {
+		q.ios.log.Warnln("Failed to persist retry state for %s: %v", item.GUID, pErr)
+	}
+	return false
+}
+
+// OnAck forgets guid for good once its IncomingSendAck has arrived. It's a
+// no-op if guid was never queued (the common case: most sends succeed on
+// the first direct attempt and never touch the queue at all).
+func (q *sendQueue) OnAck(guid string) {
+	q.lock.Lock()
+	_, awaiting := q.awaitingAck[guid]
+	_, queued := q.pending[guid]
+	ok := awaiting || queued
+	delete(q.awaitingAck, guid)
+	delete(q.pending, guid)
+	q.lock.Unlock()
+	if !ok {
+		return
+	}
+	if err := q.forget(guid); err != nil {
+		q.ios.log.Warnln("Failed to remove acknowledged item %s from send queue: %v", guid, err)
+	}
+}
@@ -0,0 +1,152 @@
+// mautrix-imessage - A Matrix-iMessage puppeting bridge.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package ios
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"go.mau.fi/mautrix-imessage/imessage"
+)
+
+func TestBackoffFor(t *testing.T) {
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{0, 1 * time.Second},
+		{1, 2 * time.Second},
+		{2, 4 * time.Second},
+		{3, 8 * time.Second},
+	}
+	for _, tc := range tests {
+		if got := backoffFor(tc.attempts); got != tc.want {
+			t.Errorf("backoffFor(%d) = %s, want %s", tc.attempts, got, tc.want)
+		}
+	}
+}
+
+func TestBackoffForCapsAtMax(t *testing.T) {
+	if got := backoffFor(sendQueueMaxAttempts); got != sendQueueMaxBackoff {
+		t.Errorf("backoffFor(%d) = %s, want %s", sendQueueMaxAttempts, got, sendQueueMaxBackoff)
+	}
+	if got := backoffFor(100); got != sendQueueMaxBackoff {
+		t.Errorf("backoffFor(100) = %s, want %s", got, sendQueueMaxBackoff)
+	}
+}
+
+// pendingItem fetches guid out of q.pending for test inspection/driving.
+func pendingItem(q *sendQueue, guid string) *queuedSend {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return q.pending[guid]
+}
+
+func TestSendQueueRetriesThenGivesUp(t *testing.T) {
+	svc := &stubService{
+		sendMessage: func(context.Context, *SendMessageRequest) (*imessage.SendResponse, error) {
+			return nil, errors.New("iOS peer unreachable")
+		},
+	}
+	ios := newTestConnector(t, svc)
+	defer ios.sendQueue.Stop()
+
+	id, _ := ios.registerPendingAck()
+	if err := ios.sendQueue.EnqueueMessage(id, "chat-guid", "hello"); err != nil {
+		t.Fatalf("EnqueueMessage failed: %v", err)
+	}
+
+	item := pendingItem(ios.sendQueue, id)
+	if item == nil {
+		t.Fatalf("enqueued item %s not found in pending", id)
+	}
+	for i := 0; i < sendQueueMaxAttempts; i++ {
+		if done := ios.sendQueue.trySend(item); done {
+			if i != sendQueueMaxAttempts-1 {
+				t.Fatalf("trySend gave up after %d attempts, want %d", i+1, sendQueueMaxAttempts)
+			}
+			break
+		} else if i == sendQueueMaxAttempts-1 {
+			t.Fatalf("trySend did not give up after %d attempts", sendQueueMaxAttempts)
+		}
+	}
+
+	if pendingItem(ios.sendQueue, id) != nil {
+		t.Errorf("abandoned item %s still present in pending", id)
+	}
+	ios.pendingAcksLock.Lock()
+	_, stillPending := ios.pendingAcks[id]
+	ios.pendingAcksLock.Unlock()
+	if stillPending {
+		t.Errorf("pendingAcks entry for abandoned item %s was not cleaned up", id)
+	}
+}
+
+func TestSendQueueForgetsOnAckAndSurvivesReload(t *testing.T) {
+	svc := &stubService{
+		sendMessage: func(context.Context, *SendMessageRequest) (*imessage.SendResponse, error) {
+			return &imessage.SendResponse{}, nil
+		},
+	}
+	ios := newTestConnector(t, svc)
+
+	id, _ := ios.registerPendingAck()
+	if err := ios.sendQueue.EnqueueMessage(id, "chat-guid", "hello"); err != nil {
+		t.Fatalf("EnqueueMessage failed: %v", err)
+	}
+
+	item := pendingItem(ios.sendQueue, id)
+	if item == nil {
+		t.Fatalf("enqueued item %s not found in pending", id)
+	}
+	if !ios.sendQueue.trySend(item) {
+		t.Fatalf("trySend with a succeeding stub reported failure")
+	}
+
+	ios.sendQueue.lock.Lock()
+	_, awaiting := ios.sendQueue.awaitingAck[id]
+	ios.sendQueue.lock.Unlock()
+	if !awaiting {
+		t.Fatalf("handed-off item %s was not moved to awaitingAck", id)
+	}
+
+	ios.sendQueue.OnAck(id)
+
+	ios.sendQueue.lock.Lock()
+	_, stillAwaiting := ios.sendQueue.awaitingAck[id]
+	ios.sendQueue.lock.Unlock()
+	if stillAwaiting {
+		t.Errorf("acked item %s was not removed from awaitingAck", id)
+	}
+
+	// A fresh queue over the same db file should not reload anything:
+	// OnAck's forget() must have actually deleted the bbolt record, not
+	// just the in-memory bookkeeping. Stop the original queue first so it
+	// releases bbolt's exclusive file lock.
+	dbPath := ios.sendQueue.db.Path()
+	ios.sendQueue.Stop()
+	reloaded, err := newSendQueue(ios, dbPath)
+	if err != nil {
+		t.Fatalf("newSendQueue (reload) failed: %v", err)
+	}
+	defer reloaded.Stop()
+	if item := pendingItem(reloaded, id); item != nil {
+		t.Errorf("acked item %s reappeared after reload", id)
+	}
+}
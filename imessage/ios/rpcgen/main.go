@@ -0,0 +1,131 @@
+// mautrix-imessage - A Matrix-iMessage puppeting bridge.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// Command rpcgen generates imessage/ios/service_gen.go (the Go client stubs
+// for the Service interface in service.go) and schema.json (a
+// machine-readable description of the same calls for the iOS side) from the
+// method table below. Invoked via the go:generate directive in service.go.
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"text/template"
+)
+
+// method describes one Service call: its Go signature and the wire Command
+// it's backed by. Command is the Go identifier spliced into service_gen.go
+// as source; Wire is the same command's actual string value, the only form
+// a non-Go (iOS/Swift) consumer of schema.json can use. ReqType names the
+// request struct and RespType the method's return type (a pointer for
+// single objects, a slice otherwise). RespInit is the make(...) expression
+// that builds an empty slice response, or for single objects the struct
+// type the zero-value response is declared as.
+type method struct {
+	Name     string
+	Command  string
+	Wire     string
+	ReqType  string
+	RespType string
+	RespInit string
+	RespKind string // "slice" or "struct", used only for schema.json
+}
+
+var methods = []method{
+	{"GetRecentMessagesAfter", "ReqGetRecentMessages", "get_recent_messages", "GetMessagesAfterRequest", "[]*imessage.Message", "make([]*imessage.Message, 0)", "slice"},
+	{"GetRecentMessagesWithLimit", "ReqGetRecentMessages", "get_recent_messages", "GetRecentMessagesRequest", "[]*imessage.Message", "make([]*imessage.Message, 0)", "slice"},
+	{"GetChats", "ReqGetChats", "get_chats", "GetChatsRequest", "[]string", "make([]string, 0)", "slice"},
+	{"GetContact", "ReqGetContact", "get_contact", "GetContactRequest", "*imessage.Contact", "imessage.Contact", "struct"},
+	{"GetChat", "ReqGetChat", "get_chat", "GetChatRequest", "*imessage.ChatInfo", "imessage.ChatInfo", "struct"},
+	{"SendMessage", "ReqSendMessage", "send_message", "SendMessageRequest", "*imessage.SendResponse", "imessage.SendResponse", "struct"},
+	{"SendFile", "ReqSendFile", "send_file", "SendFileRequest", "*imessage.SendResponse", "imessage.SendResponse", "struct"},
+	{"GetGroupAvatar", "ReqGetGroupAvatar", "get_group_avatar", "GetGroupAvatarRequest", "*GetGroupAvatarResponse", "GetGroupAvatarResponse", "struct"},
+}
+
+const serviceTemplate = `// Code generated by rpcgen from the Service method table in
+// rpcgen/main.go; DO NOT EDIT.
+
+package ios
+
+import (
+	"context"
+	"time"
+
+	"go.mau.fi/mautrix-imessage/imessage"
+	"go.mau.fi/mautrix-imessage/ipc"
+)
+
+type ipcService struct {
+	ios *iOSConnector
+}
+
+func newIPCService(ios *iOSConnector) Service {
+	return &ipcService{ios: ios}
+}
+
+// call is the single choke point every generated method runs through, so
+// logging/metrics/retries only need to be added here once.
+func (s *ipcService) call(ctx context.Context, cmd ipc.Command, req, resp interface{}) error {
+	start := time.Now()
+	err := s.ios.IPC.Request(ctx, cmd, req, resp)
+	s.ios.log.Debugfln("RPC %s took %s (error: %v)", cmd, time.Since(start), err)
+	return err
+}
+{{range .}}
+func (s *ipcService) {{.Name}}(ctx context.Context, req *{{.ReqType}}) ({{.RespType}}, error) {
+{{if eq .RespKind "slice"}}	resp := {{.RespInit}}
+	err := s.call(ctx, {{.Command}}, req, &resp)
+	return resp, err
+{{else}}	var resp {{.RespInit}}
+	err := s.call(ctx, {{.Command}}, req, &resp)
+	return &resp, err
+{{end}}}
+{{end}}`
+
+type schemaMethod struct {
+	Name     string `json:"name"`
+	Command  string `json:"command"`
+	Request  string `json:"request"`
+	Response string `json:"response"`
+}
+
+func main() {
+	tmpl := template.Must(template.New("service").Parse(serviceTemplate))
+	out, err := os.Create("service_gen.go")
+	if err != nil {
+		log.Fatalf("failed to create service_gen.go: %v", err)
+	}
+	defer out.Close()
+	if err = tmpl.Execute(out, methods); err != nil {
+		log.Fatalf("failed to render service_gen.go: %v", err)
+	}
+
+	schema := make([]schemaMethod, len(methods))
+	for i, m := range methods {
+		schema[i] = schemaMethod{Name: m.Name, Command: m.Wire, Request: m.ReqType, Response: m.RespType}
+	}
+	schemaFile, err := os.Create("schema.json")
+	if err != nil {
+		log.Fatalf("failed to create schema.json: %v", err)
+	}
+	defer schemaFile.Close()
+	enc := json.NewEncoder(schemaFile)
+	enc.SetIndent("", "  ")
+	if err = enc.Encode(schema); err != nil {
+		log.Fatalf("failed to render schema.json: %v", err)
+	}
+}
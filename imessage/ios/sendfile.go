@@ -0,0 +1,234 @@
+// mautrix-imessage - A Matrix-iMessage puppeting bridge.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package ios
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"go.mau.fi/mautrix-imessage/imessage"
+	"go.mau.fi/mautrix-imessage/ipc"
+)
+
+const ReqSendFile ipc.Command = "send_file"
+
+// sendFileChunkSize is the maximum number of raw (pre-base64) bytes packed
+// into a single file frame. Keeping frames well under typical IPC transport
+// limits avoids blowing the single-JSON-message budget for large
+// attachments.
+const sendFileChunkSize = 64 * 1024
+
+// SendFileRequest is one frame of a chunked file transfer. The iOS side
+// reassembles frames sharing the same TransferID in Sequence order and
+// finishes the transfer when it sees Final set.
+type SendFileRequest struct {
+	ChatGUID   string `json:"chat_guid"`
+	TransferID string `json:"transfer_id"`
+	Sequence   int    `json:"sequence"`
+	Final      bool   `json:"final"`
+	MessageID  string `json:"message_id,omitempty"`
+
+	FileName string `json:"file_name,omitempty"`
+	MimeType string `json:"mime_type,omitempty"`
+	Data     string `json:"data"`
+}
+
+// incomingFileTransfer reassembles chunks keyed by their Sequence number so
+// that out-of-order delivery over the IPC transport doesn't corrupt the
+// result. finalSeq is -1 until the Final frame has been seen; the transfer
+// is complete once every sequence number up to finalSeq has arrived.
+type incomingFileTransfer struct {
+	chatGUID string
+	fileName string
+	mimeType string
+	chunks   map[int][]byte
+	finalSeq int
+}
+
+// ReceivedFile is an attachment reassembled from an incoming chunked file
+// transfer, delivered on iOSConnector.FileChan().
+type ReceivedFile struct {
+	ChatGUID   string
+	FileName   string
+	MimeType   string
+	Data       []byte
+	PathOnDisk string
+}
+
+func newTransferID() string {
+	var id [16]byte
+	_, _ = rand.Read(id[:])
+	return hex.EncodeToString(id[:])
+}
+
+// sanitizeFilename strips directory components and any characters that
+// aren't safe to carry over IPC or to write to disk on the receiving side.
+func sanitizeFilename(name string) string {
+	name = filepath.Base(name)
+	if name == "." || name == ".." || name == "" {
+		return "attachment"
+	}
+	var sb strings.Builder
+	for _, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '-', r == '_':
+			sb.WriteRune(r)
+		default:
+			sb.WriteRune('_')
+		}
+	}
+	return sb.String()
+}
+
+// SendFile sends data immediately if the iOS IPC peer is reachable. If the
+// transfer fails partway through, the whole file is handed to the outbound
+// queue for a fresh retry instead of failing the caller.
+func (ios *iOSConnector) SendFile(chatID, filename string, data []byte) (*imessage.SendResponse, error) {
+	id, _ := ios.registerPendingAck()
+	resp, err := ios.sendFileWithID(chatID, filename, data, id)
+	if err == nil {
+		return resp, nil
+	}
+	if queueErr := ios.sendQueue.EnqueueFile(id, chatID, filename, data); queueErr != nil {
+		ios.pendingAcksLock.Lock()
+		delete(ios.pendingAcks, id)
+		ios.pendingAcksLock.Unlock()
+		return nil, err
+	}
+	ios.log.Debugfln("Queued file %s to %s for retry after direct send failed: %v", id, chatID, err)
+	return &imessage.SendResponse{MessageID: id}, nil
+}
+
+// sendFileWithID performs one direct chunked transfer attempt under a
+// caller-chosen MessageID, so a queued retry echoes the same ID the
+// original caller is (or might later start) waiting on via WaitForDelivery.
+func (ios *iOSConnector) sendFileWithID(chatID, filename string, data []byte, id string) (*imessage.SendResponse, error) {
+	mimeType := http.DetectContentType(data)
+	transferID := newTransferID()
+	safeFilename := sanitizeFilename(filename)
+
+	var resp imessage.SendResponse
+	for offset := 0; ; offset += sendFileChunkSize {
+		end := offset + sendFileChunkSize
+		if end > len(data) {
+			end = len(data)
+		}
+		final := end == len(data)
+		req := &SendFileRequest{
+			ChatGUID:   chatID,
+			TransferID: transferID,
+			Sequence:   offset / sendFileChunkSize,
+			Final:      final,
+			MessageID:  id,
+			Data:       base64.StdEncoding.EncodeToString(data[offset:end]),
+		}
+		if offset == 0 {
+			req.FileName = safeFilename
+			req.MimeType = mimeType
+		}
+		chunkResp, err := ios.svc.SendFile(context.Background(), req)
+		if err != nil {
+			return nil, fmt.Errorf("failed to send file chunk %d: %w", req.Sequence, err)
+		}
+		resp = *chunkResp
+		if final {
+			break
+		}
+	}
+	resp.MessageID = id
+	return &resp, nil
+}
+
+// handleIncomingFile reassembles chunked file frames sent by the iOS side
+// and emits a ReceivedFile on FileChan once every frame of a transfer up to
+// the final one has arrived, mirroring how handleIncomingMessage turns IPC
+// frames into imessage.Message values.
+func (ios *iOSConnector) handleIncomingFile(data json.RawMessage) interface{} {
+	var frame SendFileRequest
+	err := json.Unmarshal(data, &frame)
+	if err != nil {
+		ios.log.Warnln("Failed to parse incoming file frame: %v", err)
+		return nil
+	}
+
+	chunk, err := base64.StdEncoding.DecodeString(frame.Data)
+	if err != nil {
+		ios.log.Warnln("Failed to decode incoming file chunk %s/%d: %v", frame.TransferID, frame.Sequence, err)
+		return nil
+	}
+
+	ios.incomingTransfersLock.Lock()
+	transfer, ok := ios.incomingTransfers[frame.TransferID]
+	if !ok {
+		transfer = &incomingFileTransfer{
+			chatGUID: frame.ChatGUID,
+			fileName: sanitizeFilename(frame.FileName),
+			mimeType: frame.MimeType,
+			chunks:   make(map[int][]byte),
+			finalSeq: -1,
+		}
+		ios.incomingTransfers[frame.TransferID] = transfer
+	}
+	transfer.chunks[frame.Sequence] = chunk
+	if frame.Final {
+		transfer.finalSeq = frame.Sequence
+	}
+	complete := transfer.finalSeq >= 0 && len(transfer.chunks) == transfer.finalSeq+1
+	if complete {
+		delete(ios.incomingTransfers, frame.TransferID)
+	}
+	ios.incomingTransfersLock.Unlock()
+
+	if !complete {
+		return nil
+	}
+
+	var buf bytes.Buffer
+	for i := 0; i <= transfer.finalSeq; i++ {
+		buf.Write(transfer.chunks[i])
+	}
+	fileData := buf.Bytes()
+	if transfer.mimeType == "" {
+		transfer.mimeType = http.DetectContentType(fileData)
+	}
+	path, err := ios.attachments.Put(fileData)
+	if err != nil {
+		ios.log.Warnln("Failed to cache incoming file %s: %v", transfer.fileName, err)
+	}
+	ios.log.Debugfln("Reassembled incoming file %s (%s, %d bytes) for chat %s", transfer.fileName, transfer.mimeType, len(fileData), transfer.chatGUID)
+	file := &ReceivedFile{
+		ChatGUID:   transfer.chatGUID,
+		FileName:   transfer.fileName,
+		MimeType:   transfer.mimeType,
+		Data:       fileData,
+		PathOnDisk: path,
+	}
+	select {
+	case ios.fileChan <- file:
+	default:
+		ios.log.Warnln("Incoming file buffer is full, dropping %s", file.FileName)
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+// mautrix-imessage - A Matrix-iMessage puppeting bridge.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package ios
+
+import (
+	"context"
+
+	"go.mau.fi/mautrix-imessage/imessage"
+)
+
+// Service is the typed RPC surface the connector calls into instead of
+// reaching for ios.IPC.Request directly. Each method is backed by one of the
+// Req* ipc.Command frames declared alongside its request/response types
+// (GetRecentMessagesAfter and GetRecentMessagesWithLimit share
+// ReqGetRecentMessages), but
+// gives callers compile-time checked signatures, per-call context
+// cancellation, and a single choke point (ipcService.call in
+// service_gen.go) to hang logging, metrics, or retries off of.
+//
+// service_gen.go and schema.json are generated from the method table
+// in rpcgen/main.go; run `go generate ./...` after changing it.
+type Service interface {
+	GetRecentMessagesAfter(ctx context.Context, req *GetMessagesAfterRequest) ([]*imessage.Message, error)
+	GetRecentMessagesWithLimit(ctx context.Context, req *GetRecentMessagesRequest) ([]*imessage.Message, error)
+	GetChats(ctx context.Context, req *GetChatsRequest) ([]string, error)
+	GetContact(ctx context.Context, req *GetContactRequest) (*imessage.Contact, error)
+	GetChat(ctx context.Context, req *GetChatRequest) (*imessage.ChatInfo, error)
+	SendMessage(ctx context.Context, req *SendMessageRequest) (*imessage.SendResponse, error)
+	SendFile(ctx context.Context, req *SendFileRequest) (*imessage.SendResponse, error)
+	GetGroupAvatar(ctx context.Context, req *GetGroupAvatarRequest) (*GetGroupAvatarResponse, error)
+}
+
+//go:generate go run ./rpcgen
@@ -0,0 +1,77 @@
+// Code generated by rpcgen from the Service method table in
+// rpcgen/main.go; DO NOT EDIT.
+
+package ios
+
+import (
+	"context"
+	"time"
+
+	"go.mau.fi/mautrix-imessage/imessage"
+	"go.mau.fi/mautrix-imessage/ipc"
+)
+
+type ipcService struct {
+	ios *iOSConnector
+}
+
+func newIPCService(ios *iOSConnector) Service {
+	return &ipcService{ios: ios}
+}
+
+// call is the single choke point every generated method runs through, so
+// logging/metrics/retries only need to be added here once.
+func (s *ipcService) call(ctx context.Context, cmd ipc.Command, req, resp interface{}) error {
+	start := time.Now()
+	err := s.ios.IPC.Request(ctx, cmd, req, resp)
+	s.ios.log.Debugfln("RPC %s took %s (error: %v)", cmd, time.Since(start), err)
+	return err
+}
+
+func (s *ipcService) GetRecentMessagesAfter(ctx context.Context, req *GetMessagesAfterRequest) ([]*imessage.Message, error) {
+	resp := make([]*imessage.Message, 0)
+	err := s.call(ctx, ReqGetRecentMessages, req, &resp)
+	return resp, err
+}
+
+func (s *ipcService) GetRecentMessagesWithLimit(ctx context.Context, req *GetRecentMessagesRequest) ([]*imessage.Message, error) {
+	resp := make([]*imessage.Message, 0)
+	err := s.call(ctx, ReqGetRecentMessages, req, &resp)
+	return resp, err
+}
+
+func (s *ipcService) GetChats(ctx context.Context, req *GetChatsRequest) ([]string, error) {
+	resp := make([]string, 0)
+	err := s.call(ctx, ReqGetChats, req, &resp)
+	return resp, err
+}
+
+func (s *ipcService) GetContact(ctx context.Context, req *GetContactRequest) (*imessage.Contact, error) {
+	var resp imessage.Contact
+	err := s.call(ctx, ReqGetContact, req, &resp)
+	return &resp, err
+}
+
+func (s *ipcService) GetChat(ctx context.Context, req *GetChatRequest) (*imessage.ChatInfo, error) {
+	var resp imessage.ChatInfo
+	err := s.call(ctx, ReqGetChat, req, &resp)
+	return &resp, err
+}
+
+func (s *ipcService) SendMessage(ctx context.Context, req *SendMessageRequest) (*imessage.SendResponse, error) {
+	var resp imessage.SendResponse
+	err := s.call(ctx, ReqSendMessage, req, &resp)
+	return &resp, err
+}
+
+func (s *ipcService) SendFile(ctx context.Context, req *SendFileRequest) (*imessage.SendResponse, error) {
+	var resp imessage.SendResponse
+	err := s.call(ctx, ReqSendFile, req, &resp)
+	return &resp, err
+}
+
+func (s *ipcService) GetGroupAvatar(ctx context.Context, req *GetGroupAvatarRequest) (*GetGroupAvatarResponse, error) {
+	var resp GetGroupAvatarResponse
+	err := s.call(ctx, ReqGetGroupAvatar, req, &resp)
+	return &resp, err
+}
@@ -0,0 +1,99 @@
+// mautrix-imessage - A Matrix-iMessage puppeting bridge.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package ios
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"go.mau.fi/mautrix-imessage/imessage"
+	log "maunium.net/go/maulogger/v2"
+)
+
+// stubService is a Service whose SendMessage/SendFile/GetGroupAvatar
+// behavior a test can script; every other method is unused by the tests and
+// just errors if accidentally exercised.
+type stubService struct {
+	sendMessage    func(ctx context.Context, req *SendMessageRequest) (*imessage.SendResponse, error)
+	sendFile       func(ctx context.Context, req *SendFileRequest) (*imessage.SendResponse, error)
+	getGroupAvatar func(ctx context.Context, req *GetGroupAvatarRequest) (*GetGroupAvatarResponse, error)
+}
+
+func (s *stubService) GetRecentMessagesAfter(context.Context, *GetMessagesAfterRequest) ([]*imessage.Message, error) {
+	return nil, errors.New("stubService: not implemented")
+}
+
+func (s *stubService) GetRecentMessagesWithLimit(context.Context, *GetRecentMessagesRequest) ([]*imessage.Message, error) {
+	return nil, errors.New("stubService: not implemented")
+}
+
+func (s *stubService) GetChats(context.Context, *GetChatsRequest) ([]string, error) {
+	return nil, errors.New("stubService: not implemented")
+}
+
+func (s *stubService) GetContact(context.Context, *GetContactRequest) (*imessage.Contact, error) {
+	return nil, errors.New("stubService: not implemented")
+}
+
+func (s *stubService) GetChat(context.Context, *GetChatRequest) (*imessage.ChatInfo, error) {
+	return nil, errors.New("stubService: not implemented")
+}
+
+func (s *stubService) SendMessage(ctx context.Context, req *SendMessageRequest) (*imessage.SendResponse, error) {
+	if s.sendMessage == nil {
+		return nil, errors.New("stubService: SendMessage not scripted")
+	}
+	return s.sendMessage(ctx, req)
+}
+
+func (s *stubService) SendFile(ctx context.Context, req *SendFileRequest) (*imessage.SendResponse, error) {
+	if s.sendFile == nil {
+		return nil, errors.New("stubService: SendFile not scripted")
+	}
+	return s.sendFile(ctx, req)
+}
+
+func (s *stubService) GetGroupAvatar(ctx context.Context, req *GetGroupAvatarRequest) (*GetGroupAvatarResponse, error) {
+	if s.getGroupAvatar == nil {
+		return nil, errors.New("stubService: GetGroupAvatar not scripted")
+	}
+	return s.getGroupAvatar(ctx, req)
+}
+
+// newTestConnector builds an iOSConnector wired to svc and a fresh send
+// queue backed by a bbolt file under t.TempDir(), without going through
+// NewiOSConnector (which requires a real imessage.Bridge).
+func newTestConnector(t *testing.T, svc Service) *iOSConnector {
+	t.Helper()
+	ios := &iOSConnector{
+		log:               log.Create(),
+		svc:               svc,
+		receiptChan:       make(chan *ReceiptUpdate, 16),
+		incomingTransfers: make(map[string]*incomingFileTransfer),
+		pendingAcks:       make(map[string]chan *imessage.SendResponse),
+		attachments:       newAttachmentCache(t.TempDir()),
+		avatarPaths:       newGroupAvatarPaths(),
+	}
+	q, err := newSendQueue(ios, filepath.Join(t.TempDir(), "send-queue.db"))
+	if err != nil {
+		t.Fatalf("newSendQueue failed: %v", err)
+	}
+	ios.sendQueue = q
+	return ios
+}